@@ -7,10 +7,8 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"math/rand/v2"
 	"net/netip"
 	"slices"
 	"strings"
@@ -21,6 +19,7 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	kube "tailscale.com/k8s-operator"
@@ -28,6 +27,7 @@ import (
 	tsapi "tailscale.com/k8s-operator/apis/v1alpha1"
 	"tailscale.com/net/dns/resolvconffile"
 	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/set"
 )
 
@@ -55,6 +55,33 @@ type ServiceReconciler struct {
 	recorder record.EventRecorder
 
 	tsNamespace string
+
+	ipamMu sync.Mutex // protects following
+	// ipam is lazily built from the ClusterConfig seen by the first call to
+	// ipAllocator, and rebuilt whenever ipamGeneration no longer matches the
+	// ClusterConfig's current Generation.
+	ipam           kube.IPAllocator
+	ipamGeneration int64
+}
+
+// ipAllocator returns the IPAllocator used to hand out Service addresses,
+// (re)building it from cc if it hasn't been built yet or cc's Class/CIDR
+// configuration has changed since it was. Rebuilding on Generation change,
+// rather than once per process, means edits to a ClusterConfig's Classes
+// take effect without an operator restart.
+func (a *ServiceReconciler) ipAllocator(ctx context.Context, cc tsapi.ClusterConfig) (kube.IPAllocator, error) {
+	a.ipamMu.Lock()
+	defer a.ipamMu.Unlock()
+	if a.ipam != nil && a.ipamGeneration == cc.Generation {
+		return a.ipam, nil
+	}
+	ipam, err := kube.NewBitmapAllocator(ctx, a.Client, a.tsNamespace, cc)
+	if err != nil {
+		return nil, err
+	}
+	a.ipam = ipam
+	a.ipamGeneration = cc.Generation
+	return a.ipam, nil
 }
 
 var (
@@ -129,6 +156,10 @@ func (a *ServiceReconciler) maybeCleanup(ctx context.Context, logger *zap.Sugare
 		return nil
 	}
 
+	if err := a.releaseIPs(ctx, logger, svc); err != nil {
+		return fmt.Errorf("failed to release allocated IP addresses: %w", err)
+	}
+
 	svc.Finalizers = append(svc.Finalizers[:ix], svc.Finalizers[ix+1:]...)
 	if err := a.Update(ctx, svc); err != nil {
 		return fmt.Errorf("failed to remove finalizer: %w", err)
@@ -171,75 +202,227 @@ func (a *ServiceReconciler) maybeProvision(ctx context.Context, logger *zap.Suga
 		return fmt.Errorf("error listing ClusterConfigs: %w", err)
 	}
 	if len(ccl.Items) < 1 {
-		logger.Info("got %d ClusterConfigs", len(ccl.Items))
+		logger.Infof("got %d ClusterConfigs, waiting for exactly one to exist", len(ccl.Items))
 		return nil
 	}
 	cc := ccl.Items[0]
 
-	cm := &corev1.ConfigMap{}
-	if err := a.Get(ctx, types.NamespacedName{Namespace: a.tsNamespace, Name: "servicerecords"}, cm); err != nil {
-		return fmt.Errorf("error getting serviceRecords ConfigMap: %w", err)
+	class, err := kube.ClassForService(svc, cc)
+	if err != nil {
+		return fmt.Errorf("error determining address class for Service: %w", err)
 	}
+	hasV4 := class.CIDRv4 != ""
+	hasV6 := class.CIDRv6 != ""
+	if !hasV4 && !hasV6 {
+		return fmt.Errorf("class %q has neither CIDRv4 nor CIDRv6 configured", class.Name)
+	}
+
+	ipam, err := a.ipAllocator(ctx, cc)
+	if err != nil {
+		return fmt.Errorf("error initializing IP allocator: %w", err)
+	}
+
 	// determine DNS name
 	svcDNSName := dnsNameForSvc(svc, cc.Spec.Domain)
 
-	// serviceRecords := &kube.Records{Version: kube.Alpha1Version}
-
-	// TODO: don't do any of this, the operator will just distribute the destinations.
-	// Containerboot itself will allocate a client -> address pair for each endpoint
-	var serviceRecords *kube.Records
-	if serviceRecordsB := cm.BinaryData["servicerecords.json"]; len(serviceRecordsB) == 0 {
-		serviceRecords = &kube.Records{Version: kube.Alpha1Version}
-	} else {
-		if err := json.Unmarshal(cm.BinaryData["servicerecords.json"], serviceRecords); err != nil {
+	cm := &corev1.ConfigMap{}
+	if err := a.Get(ctx, types.NamespacedName{Namespace: a.tsNamespace, Name: kube.ServiceRecordsConfigMapName}, cm); err != nil {
+		return fmt.Errorf("error getting serviceRecords ConfigMap: %w", err)
+	}
+	serviceRecords := &kube.Records{Version: kube.Alpha1Version}
+	if b := cm.BinaryData[kube.ServiceRecordsKey]; len(b) != 0 {
+		if err := json.Unmarshal(b, serviceRecords); err != nil {
 			return fmt.Errorf("error unmarshalling service records: %w", err)
 		}
 	}
+	if _, ok := serviceRecords.IP4[svcDNSName]; ok {
+		logger.Debugf("record for %s already exists", svcDNSName)
+		return nil
+	}
+	if _, ok := serviceRecords.IP6[svcDNSName]; ok {
+		logger.Debugf("record for %s already exists", svcDNSName)
+		return nil
+	}
+
+	// The address used for MagicDNS resolution itself must never be handed
+	// out to a Service. It is written by the proxies reconciler and is not
+	// among the records that the allocator replays on startup, so reserve
+	// it here before allocating.
+	if dnsAddr, err := netip.ParseAddr(serviceRecords.DNSAddr); err == nil {
+		if err := ipam.Reserve(dnsAddr); err != nil {
+			logger.Debugf("error reserving DNS address %s: %v", dnsAddr, err)
+		}
+	}
+
+	// Allocate before the retry loop below: ipam's allocation state lives in
+	// memory and isn't rolled back by a ConfigMap update conflict, so
+	// allocating again on every retry would leak an address per conflict.
+	var v4, v6 netip.Addr
+	if hasV4 {
+		v4, err = ipam.Allocate(class.Name, netip.IPv4Unspecified())
+		if err != nil {
+			return fmt.Errorf("error allocating IPv4 address: %w", err)
+		}
+	}
+	if hasV6 {
+		v6, err = ipam.Allocate(class.Name, netip.IPv6Unspecified())
+		if err != nil {
+			if hasV4 {
+				if relErr := ipam.Release(v4); relErr != nil {
+					logger.Infof("[unexpected] error releasing IPv4 address %s: %v", v4, relErr)
+				}
+			}
+			return fmt.Errorf("error allocating IPv6 address: %w", err)
+		}
+	}
+
+	// The servicerecords ConfigMap is read by containerboot on every Pod in
+	// the cluster, so several reconciles can race to update it. Retry on
+	// conflict rather than fail the whole reconcile, re-fetching and
+	// re-applying the addresses we already allocated above instead of
+	// allocating again.
+	var alreadyProvisioned bool
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm := &corev1.ConfigMap{}
+		if err := a.Get(ctx, types.NamespacedName{Namespace: a.tsNamespace, Name: kube.ServiceRecordsConfigMapName}, cm); err != nil {
+			return fmt.Errorf("error getting serviceRecords ConfigMap: %w", err)
+		}
+		serviceRecords := &kube.Records{Version: kube.Alpha1Version}
+		if b := cm.BinaryData[kube.ServiceRecordsKey]; len(b) != 0 {
+			if err := json.Unmarshal(b, serviceRecords); err != nil {
+				return fmt.Errorf("error unmarshalling service records: %w", err)
+			}
+		}
+		// The record-exists check above ran against a possibly stale read of
+		// this ConfigMap; re-check against what we just fetched so that a
+		// concurrent reconcile that already wrote svcDNSName's record
+		// doesn't get its addresses clobbered, orphaning the ones it
+		// allocated.
+		if _, ok := serviceRecords.IP4[svcDNSName]; ok {
+			alreadyProvisioned = true
+			return nil
+		}
+		if _, ok := serviceRecords.IP6[svcDNSName]; ok {
+			alreadyProvisioned = true
+			return nil
+		}
+		if hasV4 {
+			serviceRecords.AddrsToDomain.Insert(netip.PrefixFrom(v4, v4.BitLen()), svcDNSName)
+			mak.Set(&serviceRecords.IP4, svcDNSName, []string{v4.String()})
+		}
+		if hasV6 {
+			serviceRecords.AddrsToDomain.Insert(netip.PrefixFrom(v6, v6.BitLen()), svcDNSName)
+			mak.Set(&serviceRecords.IP6, svcDNSName, []string{v6.String()})
+		}
+		serviceRecordsB, err := json.Marshal(serviceRecords)
+		if err != nil {
+			return fmt.Errorf("error marshalling serviceRecords: %w", err)
+		}
+		mak.Set(&cm.BinaryData, kube.ServiceRecordsKey, serviceRecordsB)
+		return a.Update(ctx, cm)
+	}); err != nil {
+		if hasV4 {
+			if relErr := ipam.Release(v4); relErr != nil {
+				logger.Infof("[unexpected] error releasing IPv4 address %s: %v", v4, relErr)
+			}
+		}
+		if hasV6 {
+			if relErr := ipam.Release(v6); relErr != nil {
+				logger.Infof("[unexpected] error releasing IPv6 address %s: %v", v6, relErr)
+			}
+		}
+		return fmt.Errorf("error persisting allocated addresses: %w", err)
+	}
+	if alreadyProvisioned {
+		logger.Debugf("record for %s already exists", svcDNSName)
+		if hasV4 {
+			if relErr := ipam.Release(v4); relErr != nil {
+				logger.Infof("[unexpected] error releasing IPv4 address %s: %v", v4, relErr)
+			}
+		}
+		if hasV6 {
+			if relErr := ipam.Release(v6); relErr != nil {
+				logger.Infof("[unexpected] error releasing IPv6 address %s: %v", v6, relErr)
+			}
+		}
+	}
+	return nil
+}
 
-	if ip, ok := serviceRecords.IP4[svcDNSName]; ok {
-		logger.Infof("Record for %s found with an IP address %s", svcDNSName, ip)
+// releaseIPs removes any address records previously allocated to svc from
+// the servicerecords ConfigMap, freeing them for reuse by other Services. It
+// is called once a Service's resources have all been cleaned up, just before
+// its finalizer is removed.
+func (a *ServiceReconciler) releaseIPs(ctx context.Context, logger *zap.SugaredLogger, svc *corev1.Service) error {
+	ccl := &tsapi.ClusterConfigList{}
+	if err := a.List(ctx, ccl); err != nil {
+		return fmt.Errorf("error listing ClusterConfigs: %w", err)
+	}
+	if len(ccl.Items) < 1 {
+		logger.Debugf("no ClusterConfig found, nothing to release")
 		return nil
 	}
+	svcDNSName := dnsNameForSvc(svc, ccl.Items[0].Spec.Domain)
+
+	ipam, err := a.ipAllocator(ctx, ccl.Items[0])
+	if err != nil {
+		return fmt.Errorf("error initializing IP allocator: %w", err)
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm := &corev1.ConfigMap{}
+		if err := a.Get(ctx, types.NamespacedName{Namespace: a.tsNamespace, Name: kube.ServiceRecordsConfigMapName}, cm); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("error getting serviceRecords ConfigMap: %w", err)
+		}
+		b := cm.BinaryData[kube.ServiceRecordsKey]
+		if len(b) == 0 {
+			return nil
+		}
+		serviceRecords := &kube.Records{Version: kube.Alpha1Version}
+		if err := json.Unmarshal(b, serviceRecords); err != nil {
+			return fmt.Errorf("error unmarshalling service records: %w", err)
+		}
+
+		changed := releaseRecord(ipam, logger, serviceRecords, serviceRecords.IP4, svcDNSName)
+		changed = releaseRecord(ipam, logger, serviceRecords, serviceRecords.IP6, svcDNSName) || changed
+		if !changed {
+			return nil
+		}
 
-	// for this prototype, only look at the default class
-	// var defaultClass tsapi.Class
-	// for _, class := range cc.Spec.Classes {
-	// 	if class.Name == "default" {
-	// 		defaultClass = class
-	// 		break
-	// 	}
-	// }
-	// var v4Prefixes []netip.Prefix
-	// for _, s := range strings.Split(defaultClass.CIDRv4, ",") {
-	// 	p := netip.MustParsePrefix(strings.TrimSpace(s))
-	// 	if p.Masked() != p {
-	// 		log.Fatalf("v4 prefix %v is not a masked prefix", p)
-	// 	}
-	// 	v4Prefixes = append(v4Prefixes, p)
-	// }
-	// if len(v4Prefixes) == 0 {
-	// 	log.Fatalf("no v4 prefixes specified")
-	// }
-
-	// convert the DNS address
-	// it should have been written by the proxies reconciler
-	// dnsAddr, err := netip.ParseAddr(serviceRecords.DNSAddr)
-	// if err != nil {
-	// 	return fmt.Errorf("error parsing DNS address %s: %w", serviceRecords.DNSAddr, err)
-	// }
-
-	// ip := unusedIPv4(v4Prefixes, *serviceRecords, dnsAddr)
-
-	// now write the IP to the configmap
-	// serviceRecords.AddrsToDomain.Insert(netip.PrefixFrom(ip, ip.BitLen()), svcDNSName)
-	// serviceRecords.IP4[svcDNSName] = []string{ip.String()}
-
-	// serviceRecordsB, err := json.Marshal(serviceRecords)
-	// if err != nil {
-	// 	return fmt.Errorf("error marshalling serviceRecords: %w", err)
-	// }
-	// cm.BinaryData["serviceRecords"] = serviceRecordsB
-	return a.Update(ctx, cm)
+		serviceRecordsB, err := json.Marshal(serviceRecords)
+		if err != nil {
+			return fmt.Errorf("error marshalling serviceRecords: %w", err)
+		}
+		mak.Set(&cm.BinaryData, kube.ServiceRecordsKey, serviceRecordsB)
+		return a.Update(ctx, cm)
+	})
+}
+
+// releaseRecord removes svcDNSName's entry from addrsByDNSName (one of
+// serviceRecords.IP4 or serviceRecords.IP6), returns the freed addresses to
+// ipam, and removes the corresponding reverse mapping in
+// serviceRecords.AddrsToDomain. It reports whether serviceRecords was
+// modified.
+func releaseRecord(ipam kube.IPAllocator, logger *zap.SugaredLogger, serviceRecords *kube.Records, addrsByDNSName map[string][]string, svcDNSName string) bool {
+	addrs, ok := addrsByDNSName[svcDNSName]
+	if !ok {
+		return false
+	}
+	for _, s := range addrs {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		serviceRecords.AddrsToDomain.Delete(netip.PrefixFrom(ip, ip.BitLen()))
+		if err := ipam.Release(ip); err != nil {
+			logger.Infof("[unexpected] error releasing address %s for %s: %v", ip, svcDNSName, err)
+		}
+	}
+	delete(addrsByDNSName, svcDNSName)
+	return true
 }
 
 func validateService(svc *corev1.Service) []string {
@@ -364,35 +547,6 @@ func dnsNameForSvc(svc *corev1.Service, clusterDomain string) string {
 	return svc.Name + "-" + svc.Namespace + "." + clusterDomain
 }
 
-func unusedIPv4(serviceCIDR []netip.Prefix, serviceRecords kube.Records, dnsAddr netip.Addr) netip.Addr {
-	for _, r := range serviceCIDR {
-		ip := randV4(r)
-		for r.Contains(ip) {
-			if !isIPUsed(ip, serviceRecords) && ip != dnsAddr {
-				return ip
-			}
-			ip = ip.Next()
-		}
-	}
-	return netip.Addr{}
-}
-
-func isIPUsed(ip netip.Addr, serviceRecords kube.Records) bool {
-	_, ok := serviceRecords.AddrsToDomain.Get(ip)
-	return ok
-}
-
-// randV4 returns a random IPv4 address within the given prefix.
-func randV4(maskedPfx netip.Prefix) netip.Addr {
-	bits := 32 - maskedPfx.Bits()
-	randBits := rand.Uint32N(1 << uint(bits))
-
-	ip4 := maskedPfx.Addr().As4()
-	pn := binary.BigEndian.Uint32(ip4[:])
-	binary.BigEndian.PutUint32(ip4[:], randBits|pn)
-	return netip.AddrFrom4(ip4)
-}
-
 // domainForIP returns the domain name assigned to the given IP address and
 // whether it was found.
 // func domainForIP(ip netip.Addr, serviceRecords ) (string, bool) {
@@ -0,0 +1,375 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package kube
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	tsapi "tailscale.com/k8s-operator/apis/v1alpha1"
+)
+
+const (
+	// ServiceRecordsConfigMapName is the name of the ConfigMap that the
+	// operator uses to publish service DNS records. BitmapAllocator rebuilds
+	// its bitmaps from these records; the bitmaps themselves are not stored.
+	ServiceRecordsConfigMapName = "servicerecords"
+	// ServiceRecordsKey is the BinaryData key under which the marshalled
+	// Records are stored in the ServiceRecordsConfigMapName ConfigMap.
+	ServiceRecordsKey = "servicerecords.json"
+
+	// defaultClassName is the Class used for a Service that doesn't specify
+	// one explicitly.
+	defaultClassName = "default"
+
+	// maxBitmapHostBits bounds how large a single prefix's bitmap is allowed
+	// to get (1<<24 host addresses, a 2MiB bitmap). Classes that need more
+	// addresses than this should be split into several smaller CIDRs.
+	maxBitmapHostBits = 24
+)
+
+// IPAllocator allocates and releases addresses from the CIDR pools
+// configured on a ClusterConfig's Classes. Implementations must be safe for
+// concurrent use by multiple reconciles, so that alternate backends (such as
+// an external IPAM webhook) can be swapped in behind the same interface.
+type IPAllocator interface {
+	// Allocate returns an unused address from class's pool in the address
+	// family of family. family's own value does not matter and is never
+	// itself allocated; only its IP version is inspected, so callers
+	// typically pass netip.IPv4Unspecified() or netip.IPv6Unspecified().
+	Allocate(class string, family netip.Addr) (netip.Addr, error)
+	// Release returns ip to the pool it was allocated from, making it
+	// available for reuse.
+	Release(ip netip.Addr) error
+	// Reserve marks ip as allocated without handing it out. It is used to
+	// rebuild allocator state from records that already exist, e.g. on
+	// startup.
+	Reserve(ip netip.Addr) error
+}
+
+// BitmapAllocator is the default IPAllocator. It keeps one bitmap per
+// configured prefix, with a single bit per host address, and allocates in
+// O(1) amortized time via a per-prefix free-index cursor, falling back to a
+// linear scan once the pool gets fragmented.
+//
+// The bitmaps themselves are never separately persisted: the set of
+// allocated addresses is already durable in the servicerecords ConfigMap's
+// AddrsToDomain/IP4/IP6 fields, which are written before a reconcile
+// returns, so NewBitmapAllocator can always reconstruct an equivalent
+// BitmapAllocator by replaying those records. Persisting the bitmap bytes
+// too would just be a second, redundant copy of the same state to keep in
+// sync.
+type BitmapAllocator struct {
+	// classPrefixes maps a Class name to the prefixes configured for it, in
+	// the order they should be tried.
+	classPrefixes map[string][]netip.Prefix
+
+	mu       sync.Mutex // protects prefixes
+	prefixes map[netip.Prefix]*prefixBitmap
+}
+
+// prefixBitmap tracks allocation state for a single CIDR prefix.
+type prefixBitmap struct {
+	mu     sync.Mutex // serializes allocation within this prefix
+	prefix netip.Prefix
+	bits   []byte // one bit per host address; bit i == addrAt(prefix, i)
+	slots  int    // number of valid host addresses (1<<hostBits); may be less than len(bits)*8
+	cursor int    // next host index to probe
+}
+
+// NewBitmapAllocator constructs a BitmapAllocator for the Classes defined in
+// cc and rebuilds its in-memory bitmaps from the addresses already recorded
+// in the servicerecords ConfigMap, so that addresses allocated before a
+// restart, or before a ClusterConfig edit caused the allocator to be
+// rebuilt, aren't handed out again.
+func NewBitmapAllocator(ctx context.Context, c client.Client, namespace string, cc tsapi.ClusterConfig) (*BitmapAllocator, error) {
+	a := &BitmapAllocator{
+		classPrefixes: make(map[string][]netip.Prefix),
+		prefixes:      make(map[netip.Prefix]*prefixBitmap),
+	}
+	for _, class := range cc.Spec.Classes {
+		v4, err := ParsePrefixes(class.CIDRv4)
+		if err != nil {
+			return nil, fmt.Errorf("class %q: %w", class.Name, err)
+		}
+		v6, err := ParsePrefixes(class.CIDRv6)
+		if err != nil {
+			return nil, fmt.Errorf("class %q: %w", class.Name, err)
+		}
+		prefixes := append(v4, v6...)
+		a.classPrefixes[class.Name] = prefixes
+		for _, p := range prefixes {
+			if _, ok := a.prefixes[p]; ok {
+				continue
+			}
+			pb, err := newPrefixBitmap(p)
+			if err != nil {
+				return nil, fmt.Errorf("class %q: %w", class.Name, err)
+			}
+			a.prefixes[p] = pb
+		}
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ServiceRecordsConfigMapName}, cm); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("error getting %s ConfigMap: %w", ServiceRecordsConfigMapName, err)
+		}
+		return a, nil
+	}
+	records, err := recordsFromConfigMap(cm)
+	if err != nil {
+		return nil, fmt.Errorf("error reading existing service records: %w", err)
+	}
+	for _, addrsByDNSName := range []map[string][]string{records.IP4, records.IP6} {
+		for _, addrs := range addrsByDNSName {
+			for _, s := range addrs {
+				ip, err := netip.ParseAddr(s)
+				if err != nil {
+					continue
+				}
+				// An address outside every configured prefix (e.g. left
+				// over from a CIDR that a ClusterConfig edit removed) can
+				// never be handed out by a, so there is nothing to reserve.
+				if err := a.Reserve(ip); err != nil {
+					continue
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// Allocate implements IPAllocator.
+func (a *BitmapAllocator) Allocate(class string, family netip.Addr) (netip.Addr, error) {
+	prefixes, ok := a.classPrefixes[class]
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("no class named %q configured", class)
+	}
+	for _, p := range prefixes {
+		if p.Addr().Is4() != family.Is4() {
+			continue
+		}
+		if ip, ok := a.prefixBitmapFor(p).allocate(); ok {
+			return ip, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no unused addresses left for class %q", class)
+}
+
+// Release implements IPAllocator.
+func (a *BitmapAllocator) Release(ip netip.Addr) error {
+	pb, i, err := a.locate(ip)
+	if err != nil {
+		return err
+	}
+	pb.release(i)
+	return nil
+}
+
+// Reserve implements IPAllocator.
+func (a *BitmapAllocator) Reserve(ip netip.Addr) error {
+	pb, i, err := a.locate(ip)
+	if err != nil {
+		return err
+	}
+	pb.reserve(i)
+	return nil
+}
+
+func (a *BitmapAllocator) prefixBitmapFor(p netip.Prefix) *prefixBitmap {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.prefixes[p]
+}
+
+// locate returns the bitmap and host index backing ip, if ip falls within
+// one of a's configured prefixes.
+func (a *BitmapAllocator) locate(ip netip.Addr) (*prefixBitmap, int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for p, pb := range a.prefixes {
+		if i, ok := indexOf(p, ip); ok {
+			return pb, i, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("address %s does not belong to any configured class prefix", ip)
+}
+
+func newPrefixBitmap(p netip.Prefix) (*prefixBitmap, error) {
+	hostBits := p.Addr().BitLen() - p.Bits()
+	if hostBits > maxBitmapHostBits {
+		return nil, fmt.Errorf("prefix %s has too many host addresses for a bitmap allocator (max /%d)", p, p.Addr().BitLen()-maxBitmapHostBits)
+	}
+	n := 1 << uint(hostBits)
+	pb := &prefixBitmap{
+		prefix: p,
+		bits:   make([]byte, (n+7)/8),
+		slots:  n,
+	}
+	// Reserved addresses are never handed out; marking them allocated up
+	// front keeps the free-index scan from ever landing on them.
+	for i := 0; i < n; i++ {
+		if isReservedAddr(addrAt(p, i), p) {
+			pb.setBit(i)
+		}
+	}
+	return pb, nil
+}
+
+// allocate finds and claims a free host address, starting its search at the
+// cursor left behind by the previous call. This makes allocation O(1)
+// amortized as long as the pool isn't close to exhausted; a full scan of the
+// bitmap is the fallback once it is.
+func (pb *prefixBitmap) allocate() (netip.Addr, bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	n := pb.slots
+	for tries := 0; tries < n; tries++ {
+		i := pb.cursor
+		pb.cursor = (pb.cursor + 1) % n
+		if !pb.testBit(i) {
+			pb.setBit(i)
+			return addrAt(pb.prefix, i), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func (pb *prefixBitmap) release(i int) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.bits[i/8] &^= 1 << uint(i%8)
+}
+
+func (pb *prefixBitmap) reserve(i int) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.setBit(i)
+}
+
+func (pb *prefixBitmap) testBit(i int) bool {
+	return pb.bits[i/8]&(1<<uint(i%8)) != 0
+}
+
+func (pb *prefixBitmap) setBit(i int) {
+	pb.bits[i/8] |= 1 << uint(i%8)
+}
+
+// addrAt returns the address at host index i within p. i must be less than
+// 1<<maxBitmapHostBits, which guarantees it fits entirely within the last 4
+// bytes of p's address regardless of address family.
+func addrAt(p netip.Prefix, i int) netip.Addr {
+	raw := p.Addr().AsSlice()
+	n := len(raw)
+	v := binary.BigEndian.Uint32(raw[n-4:])
+	binary.BigEndian.PutUint32(raw[n-4:], v|uint32(i))
+	addr, _ := netip.AddrFromSlice(raw)
+	if p.Addr().Is4() {
+		addr = addr.Unmap()
+	}
+	return addr
+}
+
+// indexOf is the inverse of addrAt: it reports the host index of addr
+// within p, if addr falls within p.
+func indexOf(p netip.Prefix, addr netip.Addr) (int, bool) {
+	if !p.Contains(addr) {
+		return 0, false
+	}
+	raw := addr.AsSlice()
+	n := len(raw)
+	v := binary.BigEndian.Uint32(raw[n-4:])
+	hostBits := addr.BitLen() - p.Bits()
+	mask := uint32(1)<<uint(hostBits) - 1
+	return int(v & mask), true
+}
+
+// isReservedAddr reports whether ip is a network or broadcast address of p
+// that should never be handed out to a Service. Prefixes with fewer than two
+// host bits (e.g. /31, /32, /127, /128) have no such reserved addresses.
+func isReservedAddr(ip netip.Addr, p netip.Prefix) bool {
+	if ip.BitLen()-p.Bits() < 2 {
+		return false
+	}
+	if ip == p.Addr() {
+		return true // network address
+	}
+	return ip.Is4() && ip == lastIPv4Addr(p) // broadcast address
+}
+
+// lastIPv4Addr returns the highest address in the IPv4 prefix p (its
+// broadcast address).
+func lastIPv4Addr(p netip.Prefix) netip.Addr {
+	ip4 := p.Addr().As4()
+	bits := 32 - p.Bits()
+	mask := uint32(1)<<uint(bits) - 1
+	pn := binary.BigEndian.Uint32(ip4[:])
+	binary.BigEndian.PutUint32(ip4[:], pn|mask)
+	return netip.AddrFrom4(ip4)
+}
+
+// recordsFromConfigMap unmarshals the Records stored in cm, returning an
+// empty Records if none have been written yet.
+func recordsFromConfigMap(cm *corev1.ConfigMap) (*Records, error) {
+	records := &Records{Version: Alpha1Version}
+	if b := cm.BinaryData[ServiceRecordsKey]; len(b) != 0 {
+		if err := json.Unmarshal(b, records); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// ClassForService returns the Class that should be used to allocate an
+// address for svc: the Class named by its tailscale.com/class annotation,
+// or defaultClassName if the annotation is unset.
+func ClassForService(svc *corev1.Service, cc tsapi.ClusterConfig) (tsapi.Class, error) {
+	name := svc.Annotations[ServiceClassAnnotation]
+	if name == "" {
+		name = defaultClassName
+	}
+	for _, c := range cc.Spec.Classes {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return tsapi.Class{}, fmt.Errorf("no class named %q found in ClusterConfig %q", name, cc.Name)
+}
+
+// ServiceClassAnnotation lets a Service pick which ClusterConfig Class its
+// address should be allocated from.
+const ServiceClassAnnotation = "tailscale.com/class"
+
+// ParsePrefixes parses a comma-separated list of masked CIDR prefixes, as
+// found in a Class's CIDRv4 or CIDRv6 field. An empty csv returns a nil
+// slice and no error.
+func ParsePrefixes(csv string) ([]netip.Prefix, error) {
+	if csv == "" {
+		return nil, nil
+	}
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(csv, ",") {
+		p, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		if p.Masked() != p {
+			return nil, fmt.Errorf("CIDR %q is not a masked prefix", s)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
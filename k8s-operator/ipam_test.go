@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package kube
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAddrAtIndexOfRoundTrip(t *testing.T) {
+	for _, prefix := range []string{
+		"100.64.0.0/24",
+		"10.0.0.0/30",
+		"10.0.0.0/31",
+		"10.0.0.0/32",
+		"fd7a:115c:a1e0::/120",
+		"fd7a:115c:a1e0::/127",
+		"fd7a:115c:a1e0::/128",
+	} {
+		p := netip.MustParsePrefix(prefix)
+		hostBits := p.Addr().BitLen() - p.Bits()
+		n := 1 << uint(hostBits)
+		for i := 0; i < n; i++ {
+			addr := addrAt(p, i)
+			if !p.Contains(addr) {
+				t.Errorf("prefix %s index %d: addrAt returned %s, not contained in prefix", prefix, i, addr)
+				continue
+			}
+			got, ok := indexOf(p, addr)
+			if !ok {
+				t.Errorf("prefix %s index %d: indexOf(%s) reported not found", prefix, i, addr)
+				continue
+			}
+			if got != i {
+				t.Errorf("prefix %s index %d: round-tripped to %d", prefix, i, got)
+			}
+		}
+	}
+}
+
+func TestIsReservedAddr(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		addr     string
+		reserved bool
+	}{
+		// network and broadcast addresses
+		{"10.0.0.0/24", "10.0.0.0", true},
+		{"10.0.0.0/24", "10.0.0.255", true},
+		{"10.0.0.0/24", "10.0.0.1", false},
+		{"10.0.0.0/30", "10.0.0.0", true},
+		{"10.0.0.0/30", "10.0.0.3", true},
+		{"10.0.0.0/30", "10.0.0.1", false},
+		{"10.0.0.0/30", "10.0.0.2", false},
+		// too few host bits to reserve anything
+		{"10.0.0.0/31", "10.0.0.0", false},
+		{"10.0.0.0/31", "10.0.0.1", false},
+		{"10.0.0.0/32", "10.0.0.0", false},
+		// v6 has no broadcast address, only a network address
+		{"fd7a::/120", "fd7a::", true},
+		{"fd7a::/120", "fd7a::ff", false},
+		{"fd7a::/127", "fd7a::", false},
+		{"fd7a::/128", "fd7a::", false},
+	}
+	for _, tt := range tests {
+		p := netip.MustParsePrefix(tt.prefix)
+		addr := netip.MustParseAddr(tt.addr)
+		if got := isReservedAddr(addr, p); got != tt.reserved {
+			t.Errorf("isReservedAddr(%s, %s) = %v, want %v", tt.addr, tt.prefix, got, tt.reserved)
+		}
+	}
+}
+
+func TestPrefixBitmapAllocateExhaustion(t *testing.T) {
+	for _, prefix := range []string{"10.0.0.0/30", "10.0.0.0/31", "10.0.0.0/32", "fd7a::/127"} {
+		p := netip.MustParsePrefix(prefix)
+		pb, err := newPrefixBitmap(p)
+		if err != nil {
+			t.Fatalf("newPrefixBitmap(%s): %v", prefix, err)
+		}
+
+		var got []netip.Addr
+		for {
+			addr, ok := pb.allocate()
+			if !ok {
+				break
+			}
+			if !p.Contains(addr) {
+				t.Fatalf("prefix %s: allocate returned %s, outside the prefix", prefix, addr)
+			}
+			got = append(got, addr)
+		}
+
+		var want int
+		for i := 0; i < pb.slots; i++ {
+			if !isReservedAddr(addrAt(p, i), p) {
+				want++
+			}
+		}
+		if len(got) != want {
+			t.Errorf("prefix %s: allocated %d addresses, want %d", prefix, len(got), want)
+		}
+
+		// Every allocation should be unique.
+		seen := make(map[netip.Addr]bool)
+		for _, addr := range got {
+			if seen[addr] {
+				t.Errorf("prefix %s: address %s allocated twice", prefix, addr)
+			}
+			seen[addr] = true
+		}
+	}
+}
+
+func TestPrefixBitmapReleaseAllowsReuse(t *testing.T) {
+	// A /32 has a single allocatable address, so the second allocate can
+	// only succeed if release actually freed it.
+	p := netip.MustParsePrefix("10.0.0.0/32")
+	pb, err := newPrefixBitmap(p)
+	if err != nil {
+		t.Fatalf("newPrefixBitmap: %v", err)
+	}
+
+	addr, ok := pb.allocate()
+	if !ok {
+		t.Fatal("allocate failed on a fresh bitmap")
+	}
+	i, ok := indexOf(p, addr)
+	if !ok {
+		t.Fatalf("indexOf(%s) not found", addr)
+	}
+	pb.release(i)
+
+	if _, ok := pb.allocate(); !ok {
+		t.Fatal("allocate failed after releasing the only allocated address")
+	}
+}